@@ -0,0 +1,176 @@
+package raft
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/coreos/etcd/pkg/idutil"
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/snap"
+	"github.com/coreos/etcd/wal"
+	"github.com/docker/swarmkit/api"
+	"github.com/pivotal-golang/clock"
+	"golang.org/x/net/context"
+)
+
+// defaultTickInterval is used when NewNodeOptions.TickInterval is unset.
+const defaultTickInterval = time.Second
+
+// raftIDRand generates the random raft IDs handed out to the first node
+// of a brand new cluster. A node joining an existing cluster is instead
+// assigned an ID by the leader (see join), and a restarting node reuses
+// the ID recorded in its NewNodeOptions.ID.
+var raftIDRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// newRaftID returns a random, non-zero raft ID.
+func newRaftID() uint64 {
+	for {
+		if id := raftIDRand.Uint64(); id != 0 {
+			return id
+		}
+	}
+}
+
+// parseRaftID parses the hex-encoded node ID carried on NewNodeOptions.ID,
+// as set by a restarting node (see testutils.RestartNode). It returns
+// 0, nil if opts.ID is empty, leaving bootstrap to either generate a
+// fresh ID for a new cluster or have one assigned by the leader on Join.
+func parseRaftID(opts NewNodeOptions) (uint64, error) {
+	if opts.ID == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(opts.ID, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("raft: invalid node ID %q: %v", opts.ID, err)
+	}
+	return id, nil
+}
+
+// bootstrap brings up the etcd/raft state machine for n, building
+// n.ticker from the configured clock source and dispatching on whichever
+// of the three ways a Node comes into existence applies: recovering
+// state a previous run left on disk, joining an existing cluster through
+// opts.JoinAddr, or starting a brand new single-member cluster.
+func (n *Node) bootstrap() error {
+	clockSource := n.opts.ClockSource
+	if clockSource == nil {
+		clockSource = clock.NewClock()
+	}
+	tickInterval := n.opts.TickInterval
+	if tickInterval == 0 {
+		tickInterval = defaultTickInterval
+	}
+	n.ticker = clockSource.NewTicker(tickInterval)
+
+	if wal.Exist(n.walDir()) {
+		return n.restart()
+	}
+
+	if n.opts.JoinAddr != "" {
+		return n.join()
+	}
+
+	return n.startNewCluster()
+}
+
+// restart recovers a node's raft state from the WAL and snapshot left
+// behind in its state directory by a previous run and hands it to
+// raft.RestartNode. If ForceNewCluster is set, the memberlist this node
+// knew about before restarting is discarded, so it comes back up willing
+// to talk only to itself until new members Join it again.
+func (n *Node) restart() error {
+	w, _, _, err := n.loadAndStart()
+	if err != nil {
+		return err
+	}
+	n.wal = w
+	n.raftNode = raft.RestartNode(n.Config)
+
+	if n.opts.ForceNewCluster {
+		n.mu.Lock()
+		for id, m := range n.members {
+			if m.Client != nil {
+				m.Client.Conn.Close()
+			}
+			delete(n.members, id)
+		}
+		n.mu.Unlock()
+	}
+
+	return nil
+}
+
+// startNewCluster initializes a fresh WAL and snapshotter and starts a
+// brand new single-member cluster consisting of only this node. Other
+// members are added later as they Join.
+func (n *Node) startNewCluster() error {
+	if n.Config.ID == 0 {
+		n.Config.ID = newRaftID()
+	}
+	n.reqIDGen = idutil.NewGenerator(uint16(n.Config.ID), time.Now())
+
+	w, err := n.initWAL()
+	if err != nil {
+		return err
+	}
+	n.wal = w
+
+	self := mustMarshal(&api.RaftMember{RaftID: n.Config.ID, Addr: n.Address})
+	n.raftNode = raft.StartNode(n.Config, []raft.Peer{{ID: n.Config.ID, Context: self}})
+	return nil
+}
+
+// join asks the node at opts.JoinAddr - a member of an existing cluster -
+// to admit this one, then starts raft with the ID and initial memberlist
+// the leader handed back. The new member starts with an empty local peer
+// list: it only becomes visible to raft here once the leader's own
+// ConfChangeAddLearnerNode for it is replicated and applied, the same
+// way it is for every other member watching that log entry.
+func (n *Node) join() error {
+	client, err := ConnectToMember(n.opts.JoinAddr, n.sendTimeout())
+	if err != nil {
+		return err
+	}
+	defer client.Conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultJoinTimeout)
+	defer cancel()
+
+	resp, err := client.Join(ctx, &api.JoinRequest{Addr: n.Address})
+	if err != nil {
+		return err
+	}
+
+	n.Config.ID = resp.RaftID
+	n.reqIDGen = idutil.NewGenerator(uint16(n.Config.ID), time.Now())
+
+	for _, rm := range resp.Members {
+		if rm.RaftID == n.Config.ID {
+			continue
+		}
+		n.addRaftMember(rm, rm.IsLearner)
+	}
+
+	w, err := n.initWAL()
+	if err != nil {
+		return err
+	}
+	n.wal = w
+
+	n.raftNode = raft.StartNode(n.Config, nil)
+	return nil
+}
+
+// initWAL creates a fresh WAL and snapshotter in n's state directory, for
+// a node that has no on-disk raft state yet.
+func (n *Node) initWAL() (*wal.WAL, error) {
+	if err := os.MkdirAll(n.snapDir(), 0700); err != nil {
+		return nil, err
+	}
+	n.snapshotter = snap.New(n.snapDir())
+
+	return wal.Create(n.walDir(), nil)
+}
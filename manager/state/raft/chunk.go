@@ -0,0 +1,140 @@
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/docker/swarmkit/api"
+	"golang.org/x/net/context"
+)
+
+// maxProposalChunkSize is the largest payload that fits in a single raft
+// entry submitted by ProposeValue. etcd/raft imposes a limit on the total
+// size of a Ready batch (and the underlying gRPC transport has its own
+// message size ceiling), so a StoreActionBatch larger than this has to be
+// split across multiple raft entries instead of submitted as one.
+const maxProposalChunkSize = 1024 * 1024 // 1MB
+
+// envelopeMagic prefixes every raft entry ProposeValue produces, chunked
+// or not, so processNormalEntry can locate the embedded request ID and
+// framing without guessing at the payload format.
+var envelopeMagic = [4]byte{'s', 'w', 'c', 'k'}
+
+const envelopeHeaderLen = len(envelopeMagic) + 8 + 4 + 1 // magic + reqID + seq + last
+
+// errChunkStreamInterrupted is returned to a chunked ProposeValue caller
+// when leadership changes (or the node otherwise loses the ability to
+// keep proposing) before every chunk of the proposal has been submitted.
+// A partially-submitted chunk stream is never applied: processNormalEntry
+// only assembles and applies a proposal once it sees the chunk marked
+// Last.
+var errChunkStreamInterrupted = errors.New("raft: chunked proposal stream was interrupted by a leader change")
+
+// chunkAssembly accumulates the chunks of a single in-flight chunked
+// proposal as they are applied, keyed by request ID.
+type chunkAssembly struct {
+	data []byte
+}
+
+// encodeEntry frames a request's marshalled StoreActionBatch (or a piece
+// of one) with the request ID it belongs to, its sequence number within
+// the stream, and whether it is the final (or only) piece.
+func encodeEntry(reqID uint64, seq uint32, payload []byte, last bool) []byte {
+	buf := make([]byte, envelopeHeaderLen+len(payload))
+	copy(buf, envelopeMagic[:])
+	binary.BigEndian.PutUint64(buf[4:], reqID)
+	binary.BigEndian.PutUint32(buf[12:], seq)
+	if last {
+		buf[16] = 1
+	}
+	copy(buf[envelopeHeaderLen:], payload)
+	return buf
+}
+
+func decodeEntryHeader(data []byte) (reqID uint64, seq uint32, last bool, ok bool) {
+	if len(data) < envelopeHeaderLen {
+		return 0, 0, false, false
+	}
+	for i, b := range envelopeMagic {
+		if data[i] != b {
+			return 0, 0, false, false
+		}
+	}
+	reqID = binary.BigEndian.Uint64(data[4:])
+	seq = binary.BigEndian.Uint32(data[12:])
+	last = data[16] == 1
+	return reqID, seq, last, true
+}
+
+// proposeEntries submits entry's payload as one or more raft entries,
+// embedding reqID in each so processNormalEntry can reassemble them (and
+// the wait registry can match the result back to this call) regardless
+// of whether the payload needed to be split.
+func (n *Node) proposeEntries(ctx context.Context, reqID uint64, payload []byte) error {
+	if len(payload) <= maxProposalChunkSize {
+		return n.raftNode.Propose(ctx, encodeEntry(reqID, 0, payload, true))
+	}
+
+	// etcd/raft transparently forwards a Propose call to the current
+	// leader, so a leader change mid-stream would otherwise go
+	// unnoticed here: the term is the signal that the leadership this
+	// stream started under is no longer the one committing it.
+	term := n.raftNode.Status().Term
+
+	var seq uint32
+	for offset := 0; offset < len(payload); offset += maxProposalChunkSize {
+		if ctx.Err() != nil {
+			return errChunkStreamInterrupted
+		}
+		if n.raftNode.Status().Term != term {
+			return errChunkStreamInterrupted
+		}
+
+		end := offset + maxProposalChunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		last := end == len(payload)
+
+		if err := n.raftNode.Propose(ctx, encodeEntry(reqID, seq, payload[offset:end], last)); err != nil {
+			return errChunkStreamInterrupted
+		}
+		seq++
+	}
+	return nil
+}
+
+// applyEntry folds one applied raft entry into the reassembly buffer for
+// its request ID. Once the Last piece arrives, it unmarshals and returns
+// the reassembled StoreActionBatch along with the request ID so the
+// caller can apply it and trigger the matching waiter; until then it
+// returns a nil batch.
+func (n *Node) applyEntry(data []byte) (batch *api.StoreActionBatch, reqID uint64, err error) {
+	reqID, _, last, ok := decodeEntryHeader(data)
+	if !ok {
+		return nil, 0, errors.New("raft: malformed entry")
+	}
+	payload := data[envelopeHeaderLen:]
+
+	n.mu.Lock()
+	asm, ok := n.chunks[reqID]
+	if !ok {
+		asm = &chunkAssembly{}
+		n.chunks[reqID] = asm
+	}
+	asm.data = append(asm.data, payload...)
+	if last {
+		delete(n.chunks, reqID)
+	}
+	n.mu.Unlock()
+
+	if !last {
+		return nil, reqID, nil
+	}
+
+	sa := &api.StoreActionBatch{}
+	if err := sa.Unmarshal(asm.data); err != nil {
+		return nil, reqID, err
+	}
+	return sa, reqID, nil
+}
@@ -0,0 +1,60 @@
+package raft_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/docker/swarmkit/api"
+	raftutils "github.com/docker/swarmkit/manager/state/raft/testutils"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// proposeLargeValue proposes an api.Node whose Annotations.Name field is
+// large enough (several megabytes) to force raft to split the resulting
+// StoreActionBatch into multiple chunked entries.
+func proposeLargeValue(t *testing.T, node *raftutils.TestNode, id string, size int) (*api.Node, error) {
+	n := &api.Node{
+		ID: id,
+		Spec: api.NodeSpec{
+			Annotations: api.Annotations{Name: strings.Repeat("a", size)},
+		},
+	}
+	err := node.ProposeValue(context.Background(), []*api.StoreAction{
+		{
+			Action: api.StoreActionKindCreate,
+			Target: &api.StoreAction_Node{Node: n},
+		},
+	}, nil)
+	return n, err
+}
+
+// TestRaftProposeLargeValue verifies that a multi-megabyte proposal,
+// which must be split into several chunked raft entries, is applied
+// atomically on every node in the cluster - including a follower that
+// was down for the whole chunk stream and has to catch it up via log
+// replication or a snapshot.
+func TestRaftProposeLargeValue(t *testing.T) {
+	t.Parallel()
+
+	nodes, clockSource := raftutils.NewRaftCluster(t, tc)
+	defer raftutils.TeardownCluster(t, nodes)
+
+	// Take node 3 down before the large proposal goes out, so it has to
+	// catch up on the whole chunk stream after the fact.
+	nodes[3].Server.Stop()
+	nodes[3].Shutdown()
+
+	const sizeMB = 4
+	value, err := proposeLargeValue(t, nodes[1], "big1", sizeMB*1024*1024)
+	assert.NoError(t, err, "failed to propose large value")
+
+	raftutils.CheckValue(t, clockSource, nodes[2], value)
+
+	nodes[3] = raftutils.RestartNode(t, clockSource, nodes[3], false)
+	raftutils.WaitForCluster(t, clockSource, nodes)
+
+	for _, node := range nodes {
+		raftutils.CheckValue(t, clockSource, node, value)
+	}
+}
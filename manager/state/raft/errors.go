@@ -0,0 +1,26 @@
+package raft
+
+import "errors"
+
+var (
+	// errLeaderNotSelf is returned by calls that can only be served by the
+	// raft leader (Leave, PromoteMember, TransferLeadership) when made
+	// against a follower. Join on a follower forwards the request to the
+	// leader instead, and returns this error only when it has no
+	// connection to a known leader.
+	errLeaderNotSelf = errors.New("raft: node is not the leader")
+
+	// errMemberUnknown is returned when an operation references a raft ID
+	// that is not a current member of the cluster.
+	errMemberUnknown = errors.New("raft: member not found")
+
+	// errUnknownProposal is returned by PollProposal when called with a
+	// request ID that either never came from ProposeValueAsync or whose
+	// result was already collected by an earlier PollProposal call.
+	errUnknownProposal = errors.New("raft: unknown or already-collected proposal")
+
+	// errLearnerNotCaughtUp is returned by PromoteMember when the
+	// learner's match index is still too far behind the leader's commit
+	// index for promoting it to a voter to be safe.
+	errLearnerNotCaughtUp = errors.New("raft: learner has not caught up enough to be promoted")
+)
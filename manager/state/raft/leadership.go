@@ -0,0 +1,64 @@
+package raft
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// transferLeadershipPollInterval is how often TransferLeadership checks
+// whether the target has taken over as leader.
+const transferLeadershipPollInterval = 50 * time.Millisecond
+
+// defaultLeadershipTransferTimeout bounds how long a leader that is
+// leaving the cluster will wait for a graceful handoff to complete
+// before giving up and just removing itself, forcing a normal election.
+const defaultLeadershipTransferTimeout = 5 * time.Second
+
+// TransferLeadership asks the current leader to hand off to targetID,
+// and blocks until targetID reports itself as leader or ctx expires.
+// It is a no-op error if this node is not the leader, or if targetID is
+// not a known member of the cluster.
+func (n *Node) TransferLeadership(ctx context.Context, targetID uint64) error {
+	if !n.IsLeader() {
+		return errLeaderNotSelf
+	}
+
+	n.mu.RLock()
+	_, ok := n.members[targetID]
+	n.mu.RUnlock()
+	if !ok {
+		return errMemberUnknown
+	}
+
+	n.raftNode.TransferLeadership(ctx, n.Config.ID, targetID)
+
+	ticker := time.NewTicker(transferLeadershipPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if n.Leader() == targetID {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// pickTransferTarget returns the raft ID of some other voting member of
+// the cluster to hand leadership to, if one exists. Learners are skipped
+// since they cannot be elected leader.
+func (n *Node) pickTransferTarget() (uint64, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for id, m := range n.members {
+		if id != n.Config.ID && !m.IsLearner {
+			return id, true
+		}
+	}
+	return 0, false
+}
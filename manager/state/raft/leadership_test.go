@@ -0,0 +1,92 @@
+package raft_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/swarmkit/manager/state/raft"
+	raftutils "github.com/docker/swarmkit/manager/state/raft/testutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// TestRaftPreVotePartitionRejoin verifies that, with PreVote enabled on
+// every node, a node that was partitioned away from the cluster (and so
+// kept timing out on the leader and campaigning) does not force a real
+// election - and therefore no leader change - when it rejoins.
+func TestRaftPreVotePartitionRejoin(t *testing.T) {
+	t.Parallel()
+
+	nodes, clockSource := raftutils.NewRaftClusterWithOpts(t, tc, &raft.NewNodeOptions{PreVote: true})
+	defer raftutils.TeardownCluster(t, nodes)
+
+	leaderBefore := nodes[1].Leader()
+
+	// Simulate a partition by stopping node 3's transport without
+	// stopping its ticker: it keeps timing out on the leader and
+	// campaigning, but only in the pre-vote phase, which does not raise
+	// its term.
+	nodes[3].Server.Stop()
+
+	raftutils.AdvanceTicks(clockSource, 10)
+
+	// Restore node 3's transport; with PreVote, its campaigning should
+	// not be able to disrupt the existing leader once it can reach the
+	// cluster again.
+	l, err := net.Listen("tcp", nodes[3].Address)
+	require.NoError(t, err)
+	nodes[3].Server = grpc.NewServer()
+	nodes[3].Listener = l
+	raft.Register(nodes[3].Server, nodes[3].Node)
+	go nodes[3].Server.Serve(l)
+
+	raftutils.WaitForCluster(t, clockSource, nodes)
+
+	assert.Equal(t, leaderBefore, nodes[1].Leader())
+	assert.Equal(t, nodes[1].Leader(), nodes[2].Leader())
+}
+
+// TestRaftTransferLeadership verifies that TransferLeadership hands off
+// to the requested follower.
+func TestRaftTransferLeadership(t *testing.T) {
+	t.Parallel()
+
+	nodes, clockSource := raftutils.NewRaftCluster(t, tc)
+	defer raftutils.TeardownCluster(t, nodes)
+
+	leader := raftutils.Leader(nodes)
+	target := nodes[2]
+	if leader == nodes[2] {
+		target = nodes[3]
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := leader.TransferLeadership(ctx, target.Config.ID)
+	assert.NoError(t, err)
+
+	raftutils.AdvanceTicks(clockSource, 1)
+	assert.Equal(t, target.Config.ID, target.Leader())
+}
+
+// TestRaftTransferLeadershipToUnknownMember verifies that transferring
+// leadership to a raft ID that isn't a member of the cluster fails
+// instead of silently doing nothing.
+func TestRaftTransferLeadershipToUnknownMember(t *testing.T) {
+	t.Parallel()
+
+	nodes, _ := raftutils.NewRaftCluster(t, tc)
+	defer raftutils.TeardownCluster(t, nodes)
+
+	leader := raftutils.Leader(nodes)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err := leader.TransferLeadership(ctx, 0xdeadbeef)
+	assert.Error(t, err)
+}
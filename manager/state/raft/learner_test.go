@@ -0,0 +1,86 @@
+package raft_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/swarmkit/api"
+	raftutils "github.com/docker/swarmkit/manager/state/raft/testutils"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+// TestRaftLearnerJoin verifies that a node added to an existing cluster
+// joins as a non-voting learner: it shows up in the memberlist and
+// receives replicated values, but the cluster's voter count - and
+// therefore the quorum it takes to commit - stays unchanged until the
+// learner is explicitly promoted.
+func TestRaftLearnerJoin(t *testing.T) {
+	t.Parallel()
+
+	nodes, clockSource := raftutils.NewRaftCluster(t, tc)
+	defer raftutils.TeardownCluster(t, nodes)
+
+	nodes[4] = raftutils.NewJoinNode(t, clockSource, nodes[1].Address, tc)
+	raftutils.WaitForCluster(t, clockSource, nodes)
+
+	var learnerID uint64
+	for id, m := range raftutils.Leader(nodes).GetMemberlist() {
+		if m.IsLearner {
+			learnerID = id
+		}
+	}
+	assert.NotZero(t, learnerID, "expected the newly added node to be a learner")
+
+	voters := 0
+	for _, m := range raftutils.Leader(nodes).GetMemberlist() {
+		if !m.IsLearner {
+			voters++
+		}
+	}
+	assert.Equal(t, 3, voters, "quorum should still be based on the original 3 voters")
+
+	// The learner should still get replicated values even though it
+	// isn't counted toward quorum.
+	value, err := raftutils.ProposeValue(t, raftutils.Leader(nodes), "learner-value")
+	assert.NoError(t, err)
+	raftutils.CheckValue(t, clockSource, nodes[4], value)
+}
+
+// TestRaftPromoteLearner verifies that PromoteMember, retried until the
+// learner has caught up, converts it into a full voter that counts
+// toward quorum.
+func TestRaftPromoteLearner(t *testing.T) {
+	t.Parallel()
+
+	nodes, clockSource := raftutils.NewRaftCluster(t, tc)
+	defer raftutils.TeardownCluster(t, nodes)
+
+	nodes[4] = raftutils.NewJoinNode(t, clockSource, nodes[1].Address, tc)
+	raftutils.WaitForCluster(t, clockSource, nodes)
+
+	var learnerID uint64
+	leader := raftutils.Leader(nodes)
+	for id, m := range leader.GetMemberlist() {
+		if m.IsLearner {
+			learnerID = id
+		}
+	}
+	assert.NotZero(t, learnerID, "expected the newly added node to be a learner")
+
+	// Let the learner catch up on replication before promoting it.
+	assert.NoError(t, raftutils.PollFunc(clockSource, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := leader.PromoteMember(ctx, &api.PromoteMemberRequest{RaftID: learnerID})
+		return err
+	}))
+
+	voters := 0
+	for _, m := range leader.GetMemberlist() {
+		if !m.IsLearner {
+			voters++
+		}
+	}
+	assert.Equal(t, 4, voters, "promoted learner should now count toward quorum")
+}
@@ -0,0 +1,221 @@
+package raft
+
+import (
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/docker/swarmkit/api"
+	"golang.org/x/net/context"
+)
+
+const defaultJoinTimeout = 10 * time.Second
+
+// Join is called by a new node asking to join the raft cluster. A new
+// node may not know who the leader is yet - it only has one existing
+// member's address to go on - so a Join received by a follower is
+// forwarded to the leader rather than rejected. Once on the leader,
+// rather than admitting the new member as a voter immediately - which
+// would shift the quorum before the new member has replicated anything -
+// it is added as a non-voting learner via addMember's isLearner flag.
+// Once the leader sees the learner has caught up, PromoteMember converts
+// it to a full voter.
+func (n *Node) Join(ctx context.Context, req *api.JoinRequest) (*api.JoinResponse, error) {
+	if !n.IsLeader() {
+		return n.forwardToLeader(ctx, req)
+	}
+
+	raftID, err := n.newMemberID()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := n.addMember(ctx, raftID, req.Addr, true); err != nil {
+		return nil, err
+	}
+
+	return &api.JoinResponse{
+		RaftID:  raftID,
+		Members: n.raftMembers(),
+	}, nil
+}
+
+// forwardToLeader relays a JoinRequest to the node's current leader over
+// the same connection other members' raft traffic already uses, so a
+// node that only knows the address of some follower can still join the
+// cluster through it.
+func (n *Node) forwardToLeader(ctx context.Context, req *api.JoinRequest) (*api.JoinResponse, error) {
+	leaderID := n.Leader()
+
+	n.mu.RLock()
+	leader, ok := n.members[leaderID]
+	n.mu.RUnlock()
+	if !ok || leader.Client == nil {
+		return nil, errLeaderNotSelf
+	}
+
+	return leader.Client.Join(ctx, req)
+}
+
+// PromoteMember converts the learner identified by req.RaftID into a
+// full voting member, once it has caught up closely enough with the
+// leader's commit index that the quorum shift it causes is safe.
+// Promoting a member that is not (or not yet) a learner is a no-op.
+func (n *Node) PromoteMember(ctx context.Context, req *api.PromoteMemberRequest) (*api.PromoteMemberResponse, error) {
+	if !n.IsLeader() {
+		return nil, errLeaderNotSelf
+	}
+
+	n.mu.RLock()
+	m, ok := n.members[req.RaftID]
+	n.mu.RUnlock()
+	if !ok {
+		return nil, errMemberUnknown
+	}
+
+	if !m.IsLearner {
+		return &api.PromoteMemberResponse{}, nil
+	}
+
+	if !n.learnerCaughtUp(req.RaftID) {
+		return nil, errLearnerNotCaughtUp
+	}
+
+	cc := raftpb.ConfChange{
+		Type:    raftpb.ConfChangeAddNode,
+		NodeID:  req.RaftID,
+		Context: mustMarshal(&api.RaftMember{RaftID: req.RaftID, Addr: m.Addr}),
+	}
+	if err := n.proposeConfChange(ctx, cc); err != nil {
+		return nil, err
+	}
+
+	return &api.PromoteMemberResponse{}, nil
+}
+
+// learnerCatchUpThreshold is how many log entries behind the leader's
+// commit index a learner's match index is allowed to be before
+// PromoteMember will agree to convert it to a voter.
+const learnerCatchUpThreshold = 100
+
+func (n *Node) learnerCaughtUp(raftID uint64) bool {
+	status := n.raftNode.Status()
+	progress, ok := status.Progress[raftID]
+	if !ok {
+		return false
+	}
+	return status.Commit >= progress.Match && status.Commit-progress.Match <= learnerCatchUpThreshold
+}
+
+// Leave is called by an existing member asking to leave the cluster. It
+// proposes a ConfChangeRemoveNode and waits for it to be applied before
+// replying.
+func (n *Node) Leave(ctx context.Context, req *api.LeaveRequest) (*api.LeaveResponse, error) {
+	if !n.IsLeader() {
+		return nil, errLeaderNotSelf
+	}
+
+	// If the leader itself is leaving, hand off leadership first so the
+	// cluster doesn't have to fall back on a random re-election the
+	// moment this member's ConfChangeRemoveNode is applied.
+	if req.Node.RaftID == n.Config.ID {
+		if target, ok := n.pickTransferTarget(); ok {
+			tctx, cancel := context.WithTimeout(ctx, defaultLeadershipTransferTimeout)
+			err := n.TransferLeadership(tctx, target)
+			cancel()
+			if err != nil {
+				n.Config.Logger.Warningf("raft: leadership transfer before leave failed, falling back to election: %v", err)
+			}
+		}
+	}
+
+	if err := n.removeMember(ctx, req.Node.RaftID); err != nil {
+		return nil, err
+	}
+
+	return &api.LeaveResponse{}, nil
+}
+
+func (n *Node) raftMembers() []*api.RaftMember {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	members := make([]*api.RaftMember, 0, len(n.members))
+	for _, m := range n.members {
+		members = append(members, m.RaftMember)
+	}
+	return members
+}
+
+// addMember proposes a ConfChange adding raftID/addr to the cluster -
+// as a learner if isLearner is set, otherwise as a full voter - and
+// blocks until the change has been applied locally.
+func (n *Node) addMember(ctx context.Context, raftID uint64, addr string, isLearner bool) error {
+	member := &api.RaftMember{RaftID: raftID, Addr: addr, IsLearner: isLearner}
+	cc := raftpb.ConfChange{
+		Type:    raftpb.ConfChangeAddNode,
+		NodeID:  raftID,
+		Context: mustMarshal(member),
+	}
+	if isLearner {
+		cc.Type = raftpb.ConfChangeAddLearnerNode
+	}
+	return n.proposeConfChange(ctx, cc)
+}
+
+// removeMember proposes a ConfChangeRemoveNode for raftID and blocks
+// until the change has been applied locally.
+func (n *Node) removeMember(ctx context.Context, raftID uint64) error {
+	cc := raftpb.ConfChange{
+		Type:   raftpb.ConfChangeRemoveNode,
+		NodeID: raftID,
+	}
+	return n.proposeConfChange(ctx, cc)
+}
+
+// proposeConfChange assigns cc a request ID and registers a waiter for it
+// with the same reqIDGen/wait registry propose uses for value proposals,
+// so that - unlike a bare raftNode.ProposeConfChange, which only hands
+// the change to etcd/raft's local pipeline - it actually blocks until
+// processConfChange has applied it (or ctx expires).
+func (n *Node) proposeConfChange(ctx context.Context, cc raftpb.ConfChange) error {
+	cc.ID = n.reqIDGen.Next()
+	ch := n.wait.Register(cc.ID)
+
+	ctx, cancel := context.WithTimeout(ctx, defaultJoinTimeout)
+	defer cancel()
+
+	if err := n.raftNode.ProposeConfChange(ctx, cc); err != nil {
+		n.wait.Trigger(cc.ID, err)
+		return err
+	}
+
+	select {
+	case x := <-ch:
+		err, _ := x.(error)
+		return err
+	case <-ctx.Done():
+		n.wait.Trigger(cc.ID, ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// newMemberID picks an unused raft ID for a node joining the cluster.
+func (n *Node) newMemberID() (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for {
+		id := uint64(time.Now().UnixNano())
+		if _, ok := n.members[id]; !ok && !n.removed[id] {
+			return id, nil
+		}
+	}
+}
+
+func mustMarshal(m *api.RaftMember) []byte {
+	data, err := m.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
@@ -0,0 +1,502 @@
+package raft
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/coreos/etcd/pkg/idutil"
+	"github.com/coreos/etcd/pkg/wait"
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/snap"
+	"github.com/coreos/etcd/wal"
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/manager/state/store"
+	"github.com/pivotal-golang/clock"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+const (
+	// defaultHeartbeatTick is the number of ticks between heartbeats.
+	defaultHeartbeatTick = 1
+
+	// defaultElectionTick is the number of ticks that can occur before
+	// a follower initiates an election.
+	defaultElectionTick = 3
+
+	// defaultProposeTimeout is the timeout a proposal is allowed to take
+	// before it is considered failed.
+	defaultProposeTimeout = 10 * time.Second
+
+	// defaultSendTimeout is the timeout on the grpc send to another raft
+	// member.
+	defaultSendTimeout = 2 * time.Second
+)
+
+// NewNodeOptions provides arguments for NewNode.
+type NewNodeOptions struct {
+	// ID is the node's ID, used by raft.
+	ID string
+	// Addr is the address of this node's listener.
+	Addr string
+	// JoinAddr is the address of a node in an existing cluster to join.
+	// If this is not set, a new cluster will be created.
+	JoinAddr string
+	// Config is the raft config.
+	Config *raft.Config
+	// StateDir is the directory backing the raft WAL and snapshots.
+	StateDir string
+	// TickInterval is the time interval between raft ticks.
+	TickInterval time.Duration
+	// ClockSource is used to generate the raft ticker. Tests substitute
+	// a fake clock here.
+	ClockSource clock.Clock
+	// SendTimeout is the timeout on the grpc send to another raft member.
+	SendTimeout time.Duration
+	// SnapshotCount is the number of applied raft log entries after which
+	// a snapshot is triggered, overriding defaultSnapshotCount. Tests use
+	// this to exercise compaction without applying thousands of entries.
+	SnapshotCount uint64
+	// ForceNewCluster discards the existing memberlist on restart and
+	// starts a single-member cluster consisting of only this node.
+	ForceNewCluster bool
+	// PreVote enables etcd/raft's pre-vote phase. A node that lost touch
+	// with the leader (for example because it was partitioned off)
+	// campaigns in pre-vote first and only bumps its term - disrupting
+	// the current leader - if it learns it could actually win a real
+	// election. Without it, a rejoining partitioned node forces an
+	// unnecessary re-election just by raising its term.
+	PreVote bool
+}
+
+// member tracks what this node knows about a member of the raft cluster,
+// including how to reach it.
+type member struct {
+	*api.RaftMember
+
+	Client *raftClient
+}
+
+// Node is the local instance of raft and is the state machine being
+// replicated across the cluster.
+type Node struct {
+	raftNode raft.Node
+
+	Server   *grpc.Server
+	Address  string
+	StateDir string
+
+	Config *raft.Config
+	opts   NewNodeOptions
+
+	memoryStore *store.MemoryStore
+	raftStore   *raft.MemoryStorage
+	wal         *wal.WAL
+	snapshotter *snap.Snapshotter
+	confState   raftpb.ConfState
+
+	// appliedIndex and snapshotIndex track, respectively, the index of
+	// the last entry applied to memoryStore and the index covered by the
+	// most recent snapshot. Their difference drives snapshot triggering.
+	appliedIndex  uint64
+	snapshotIndex uint64
+
+	ticker clock.Ticker
+
+	mu      sync.RWMutex
+	members map[uint64]*member
+	removed map[uint64]bool
+
+	// reqIDGen and wait replace the earlier approach of keying a
+	// proposal's result channel off the marshalled entry bytes
+	// themselves. Every proposal is now assigned a request ID from
+	// reqIDGen before it is submitted, and registered with wait so that
+	// applying the entry (or abandoning it on leader change/ctx cancel)
+	// can find and trigger the right waiter unambiguously, even for two
+	// proposals with identical payloads in flight at once.
+	reqIDGen *idutil.Generator
+	wait     wait.Wait
+
+	// pending holds the result channel for a proposal submitted via
+	// ProposeValueAsync until the caller collects it with PollProposal.
+	pending map[uint64]<-chan interface{}
+
+	chunks map[uint64]*chunkAssembly
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// NewNode generates a new raft node and brings up its etcd/raft state
+// machine: Config.ID is populated from opts.ID (parsed) or assigned (by
+// the leader on Join, or at random for a brand new cluster), and
+// raft.StartNode/RestartNode is called so that n.Run is ready to serve
+// its main loop as soon as NewNode returns.
+func NewNode(opts NewNodeOptions) (*Node, error) {
+	cfg := opts.Config
+	if cfg == nil {
+		cfg = DefaultRaftConfig()
+	}
+	cfg.PreVote = opts.PreVote
+
+	id, err := parseRaftID(opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ID = id
+
+	n := &Node{
+		Address:     opts.Addr,
+		StateDir:    opts.StateDir,
+		Config:      cfg,
+		opts:        opts,
+		memoryStore: store.NewMemoryStore(nil),
+		raftStore:   raft.NewMemoryStorage(),
+		members:     make(map[uint64]*member),
+		removed:     make(map[uint64]bool),
+		reqIDGen:    idutil.NewGenerator(uint16(cfg.ID), time.Now()),
+		wait:        wait.New(),
+		pending:     make(map[uint64]<-chan interface{}),
+		chunks:      make(map[uint64]*chunkAssembly),
+		stopCh:      make(chan struct{}),
+		doneCh:      make(chan struct{}),
+	}
+	cfg.Storage = n.raftStore
+
+	if err := n.bootstrap(); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// DefaultRaftConfig returns a raft config with the default tick and timeout
+// settings used throughout swarmkit.
+func DefaultRaftConfig() *raft.Config {
+	return &raft.Config{
+		ElectionTick:    defaultElectionTick,
+		HeartbeatTick:   defaultHeartbeatTick,
+		MaxSizePerMsg:   math.MaxUint16,
+		MaxInflightMsgs: 256,
+		Logger:          logrus.NewEntry(logrus.StandardLogger()),
+	}
+}
+
+// MemoryStore returns the memory store that is kept in sync with the raft
+// log.
+func (n *Node) MemoryStore() *store.MemoryStore {
+	return n.memoryStore
+}
+
+// IsLeader checks if this node is the current raft leader.
+func (n *Node) IsLeader() bool {
+	return n.Leader() == n.Config.ID
+}
+
+// Leader returns the id of the current raft leader.
+func (n *Node) Leader() uint64 {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.raftNode.Status().Lead
+}
+
+// GetMemberlist returns the list of members associated with the given
+// raft cluster, keyed by raft ID.
+func (n *Node) GetMemberlist() map[uint64]*api.RaftMember {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	list := make(map[uint64]*api.RaftMember)
+	for k, v := range n.members {
+		list[k] = v.RaftMember
+	}
+	return list
+}
+
+// Run is the main loop for a raft node. It proceeds through the etcd/raft
+// state machine, persisting hard state and entries, applying committed
+// entries to the store, and forwarding outbound messages to peers.
+func (n *Node) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-n.ticker.C():
+			n.raftNode.Tick()
+		case rd := <-n.raftNode.Ready():
+			if err := n.saveToStorage(rd.HardState, rd.Entries, rd.Snapshot); err != nil {
+				return err
+			}
+			n.send(rd.Messages)
+
+			if !raft.IsEmptySnap(rd.Snapshot) {
+				if err := n.restoreFromSnapshot(rd.Snapshot); err != nil {
+					return err
+				}
+			}
+
+			for _, entry := range rd.CommittedEntries {
+				n.processEntry(entry)
+			}
+
+			n.raftNode.Advance()
+		case <-n.stopCh:
+			close(n.doneCh)
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Stop stops the raft node processing loop.
+func (n *Node) Stop() {
+	close(n.stopCh)
+	<-n.doneCh
+}
+
+// Shutdown stops the raft node processing loop, like Stop, and also
+// releases the WAL's file lock on StateDir. A node that was only Stop'd
+// still holds that lock, so a restarted node bound to the same StateDir
+// (see testutils.RestartNode) would block trying to reopen the WAL;
+// Shutdown is the version to call before that happens.
+func (n *Node) Shutdown() {
+	n.Stop()
+	if n.wal != nil {
+		if err := n.wal.Close(); err != nil {
+			n.Config.Logger.Errorf("raft: failed to close WAL: %v", err)
+		}
+	}
+}
+
+// ProposeValue proposes a new set of store actions to the raft cluster and
+// waits for the resulting log entry (or entries, if the proposal had to
+// be split into a chunk stream) to be applied locally before returning,
+// or for the context to expire.
+func (n *Node) ProposeValue(ctx context.Context, storeAction []*api.StoreAction, cb func()) error {
+	reqID, ch, err := n.propose(ctx, storeAction)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case x := <-ch:
+		err, _ := x.(error)
+		if err == nil && cb != nil {
+			cb()
+		}
+		return err
+	case <-ctx.Done():
+		// The proposal may still commit after we stop waiting on it; by
+		// triggering the waiter ourselves we make sure processNormalEntry's
+		// eventual Trigger call is a harmless no-op instead of leaking
+		// an entry in n.wait forever.
+		n.wait.Trigger(reqID, ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// ProposeValueAsync submits a proposal without blocking for it to be
+// applied, returning a request ID the caller can later pass to
+// PollProposal to collect the result. This is useful for callers that
+// want to pipeline several proposals rather than serialize on
+// ProposeValue's round trip for each one.
+func (n *Node) ProposeValueAsync(ctx context.Context, storeAction []*api.StoreAction) (uint64, error) {
+	reqID, ch, err := n.propose(ctx, storeAction)
+	if err != nil {
+		return reqID, err
+	}
+
+	n.mu.Lock()
+	n.pending[reqID] = ch
+	n.mu.Unlock()
+
+	return reqID, nil
+}
+
+// PollProposal blocks until the proposal identified by reqID (as returned
+// by ProposeValueAsync) has a result, or ctx expires. It can only be
+// called once per reqID: the first caller to collect the result consumes
+// it.
+func (n *Node) PollProposal(ctx context.Context, reqID uint64) error {
+	n.mu.Lock()
+	ch, ok := n.pending[reqID]
+	if ok {
+		delete(n.pending, reqID)
+	}
+	n.mu.Unlock()
+
+	if !ok {
+		return errUnknownProposal
+	}
+
+	select {
+	case x := <-ch:
+		err, _ := x.(error)
+		return err
+	case <-ctx.Done():
+		n.wait.Trigger(reqID, ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// propose assigns a fresh request ID to storeAction, registers a waiter
+// for it, and submits it to raft (splitting it into a chunk stream if it
+// is too large for a single entry). The returned channel receives the
+// applied result (nil, or an error) exactly once.
+func (n *Node) propose(ctx context.Context, storeAction []*api.StoreAction) (uint64, <-chan interface{}, error) {
+	payload, err := (&api.StoreActionBatch{Actions: storeAction}).Marshal()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	reqID := n.reqIDGen.Next()
+	ch := n.wait.Register(reqID)
+
+	if err := n.proposeEntries(ctx, reqID, payload); err != nil {
+		n.wait.Trigger(reqID, err)
+		return reqID, nil, err
+	}
+
+	return reqID, ch, nil
+}
+
+func (n *Node) processEntry(entry raftpb.Entry) {
+	switch entry.Type {
+	case raftpb.EntryNormal:
+		n.processNormalEntry(entry)
+	case raftpb.EntryConfChange:
+		n.processConfChange(entry)
+	}
+	n.appliedIndex = entry.Index
+}
+
+// processNormalEntry folds an applied entry into its request's
+// reassembly buffer (a no-op pass-through for the common case of a
+// request that fit in a single entry), and once the full request is
+// available, applies it to the store and triggers the waiter registered
+// for its request ID, if any is still waiting.
+func (n *Node) processNormalEntry(entry raftpb.Entry) {
+	if len(entry.Data) == 0 {
+		return
+	}
+
+	sa, reqID, err := n.applyEntry(entry.Data)
+	if sa == nil && err == nil {
+		// Not the final piece of a chunked request yet.
+		return
+	}
+
+	if err == nil {
+		n.applyStoreActions(sa.Actions)
+	}
+
+	if n.wait.IsRegistered(reqID) {
+		n.wait.Trigger(reqID, err)
+	}
+}
+
+func (n *Node) applyStoreActions(actions []*api.StoreAction) {
+	n.memoryStore.ApplyStoreActions(actions)
+}
+
+func (n *Node) processConfChange(entry raftpb.Entry) {
+	var cc raftpb.ConfChange
+	if err := cc.Unmarshal(entry.Data); err != nil {
+		return
+	}
+
+	switch cc.Type {
+	case raftpb.ConfChangeAddNode, raftpb.ConfChangeAddLearnerNode:
+		rm := &api.RaftMember{}
+		if err := rm.Unmarshal(cc.Context); err == nil {
+			n.addRaftMember(rm, cc.Type == raftpb.ConfChangeAddLearnerNode)
+		}
+	case raftpb.ConfChangeRemoveNode:
+		n.removeRaftMember(cc.NodeID)
+	}
+
+	n.confState = *n.raftNode.ApplyConfChange(cc)
+
+	if n.wait.IsRegistered(cc.ID) {
+		n.wait.Trigger(cc.ID, nil)
+	}
+}
+
+func (n *Node) addRaftMember(rm *api.RaftMember, isLearner bool) {
+	rm.IsLearner = isLearner
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// A ConfChange for a raft ID this node has already removed (for
+	// example, a promotion for a member that a concurrent Leave is
+	// tearing down) must not resurrect it.
+	if n.removed[rm.RaftID] {
+		return
+	}
+
+	// PromoteMember re-proposes an already-joined learner as a voter,
+	// which replays this same ConfChangeAddNode path. Reuse the
+	// existing connection in that case instead of redialing and leaking
+	// the old one.
+	if existing, ok := n.members[rm.RaftID]; ok && existing.Client != nil {
+		existing.RaftMember = rm
+		return
+	}
+
+	client, err := ConnectToMember(rm.Addr, n.sendTimeout())
+	if err != nil {
+		n.Config.Logger.Errorf("raft: failed to connect to new member %x: %v", rm.RaftID, err)
+	}
+	n.members[rm.RaftID] = &member{RaftMember: rm, Client: client}
+}
+
+func (n *Node) removeRaftMember(raftID uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if m, ok := n.members[raftID]; ok {
+		if m.Client != nil {
+			m.Client.Conn.Close()
+		}
+		delete(n.members, raftID)
+	}
+	n.removed[raftID] = true
+}
+
+func (n *Node) send(messages []raftpb.Message) {
+	for _, m := range messages {
+		go n.sendToMember(m)
+	}
+}
+
+func (n *Node) sendToMember(m raftpb.Message) {
+	n.mu.RLock()
+	member, ok := n.members[m.To]
+	n.mu.RUnlock()
+
+	if !ok || member.Client == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.sendTimeout())
+	defer cancel()
+
+	if err := member.Client.send(ctx, m); err != nil {
+		n.raftNode.ReportUnreachable(m.To)
+		if m.Type == raftpb.MsgSnap {
+			n.raftNode.ReportSnapshot(m.To, raft.SnapshotFailure)
+		}
+	} else if m.Type == raftpb.MsgSnap {
+		n.raftNode.ReportSnapshot(m.To, raft.SnapshotFinish)
+	}
+}
+
+func (n *Node) sendTimeout() time.Duration {
+	if n.opts.SendTimeout != 0 {
+		return n.opts.SendTimeout
+	}
+	return defaultSendTimeout
+}
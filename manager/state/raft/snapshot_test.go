@@ -0,0 +1,54 @@
+package raft_test
+
+import (
+	"testing"
+
+	"github.com/docker/swarmkit/api"
+	"github.com/docker/swarmkit/manager/state/raft"
+	raftutils "github.com/docker/swarmkit/manager/state/raft/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRaftSnapshotRestart is analogous to TestRaftRejoin, except node 3 is
+// kept offline for long enough that the log entries it needs have already
+// been compacted out from under it by the other two nodes. It can only
+// catch up by receiving a snapshot over StreamRaftMessage, rather than by
+// replaying the raw log.
+func TestRaftSnapshotRestart(t *testing.T) {
+	t.Parallel()
+
+	// A SnapshotCount of 1 means a snapshot (and compaction) is triggered
+	// as soon as more than one entry has been applied since the last one,
+	// so the two proposals below compact away whatever node 3 still needs.
+	nodes, clockSource := raftutils.NewRaftClusterWithOpts(t, tc, &raft.NewNodeOptions{SnapshotCount: 1})
+	defer raftutils.TeardownCluster(t, nodes)
+
+	// Propose an initial value that node 3 will see before going down.
+	ids := []string{"id1"}
+	values := make([]*api.Node, 3)
+	var err error
+	values[0], err = raftutils.ProposeValue(t, nodes[1], ids[0])
+	assert.NoError(t, err, "failed to propose value")
+
+	raftutils.CheckValue(t, clockSource, nodes[3], values[0])
+
+	// Take node 3 down.
+	nodes[3].Server.Stop()
+	nodes[3].Shutdown()
+
+	// Propose enough additional values on the remaining two nodes to
+	// cross the (test-configured, low) snapshot threshold, so that the
+	// entries node 3 still needs get compacted away.
+	ids = append(ids, "id2", "id3")
+	for i := 1; i < 3; i++ {
+		values[i], err = raftutils.ProposeValue(t, nodes[1], ids[i])
+		assert.NoError(t, err, "failed to propose value")
+	}
+
+	// Bring node 3 back. It has missed entries that no longer exist in
+	// the leader's log, so it must recover via a full snapshot transfer.
+	nodes[3] = raftutils.RestartNode(t, clockSource, nodes[3], false)
+	raftutils.WaitForCluster(t, clockSource, nodes)
+
+	raftutils.CheckValuesOnNodes(t, clockSource, nodes, ids, values)
+}
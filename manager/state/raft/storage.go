@@ -0,0 +1,193 @@
+package raft
+
+import (
+	"path/filepath"
+
+	"github.com/coreos/etcd/raft"
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/coreos/etcd/snap"
+	"github.com/coreos/etcd/wal"
+	"github.com/coreos/etcd/wal/walpb"
+)
+
+// defaultSnapshotCount is the number of applied raft log entries after
+// which a new snapshot is triggered, compacting the in-memory raft log up
+// to that many entries before it. WAL files are not removed. It can be
+// overridden with NewNodeOptions.SnapshotCount for tests that want to
+// exercise compaction quickly.
+const defaultSnapshotCount = 10000
+
+func (n *Node) walDir() string {
+	return filepath.Join(n.StateDir, "wal")
+}
+
+func (n *Node) snapDir() string {
+	return filepath.Join(n.StateDir, "snap")
+}
+
+// saveToStorage persists the given hard state, entries and snapshot to the
+// WAL, and applies them to the in-memory raft storage used to serve
+// future log reads. It is called on every tick of the Ready loop, before
+// any of the messages in the same Ready are sent out, so that a crash
+// right after sending never loses data a peer believes was durable.
+func (n *Node) saveToStorage(hs raftpb.HardState, entries []raftpb.Entry, snapshot raftpb.Snapshot) error {
+	if !raft.IsEmptySnap(snapshot) {
+		if err := n.saveSnapshot(snapshot); err != nil {
+			return err
+		}
+		if err := n.raftStore.ApplySnapshot(snapshot); err != nil {
+			return err
+		}
+	}
+
+	if err := n.wal.Save(hs, entries); err != nil {
+		return err
+	}
+
+	if len(entries) > 0 {
+		if err := n.raftStore.Append(entries); err != nil {
+			return err
+		}
+	}
+
+	if !raft.IsEmptyHardState(hs) {
+		if err := n.raftStore.SetHardState(hs); err != nil {
+			return err
+		}
+	}
+
+	n.maybeTriggerSnapshot()
+
+	return nil
+}
+
+// saveSnapshot writes a raft snapshot to the snapshotter's directory on
+// disk and records it in the WAL so that future WAL replays know where to
+// stop and load the snapshot instead.
+func (n *Node) saveSnapshot(snapshot raftpb.Snapshot) error {
+	if err := n.snapshotter.SaveSnap(snapshot); err != nil {
+		return err
+	}
+
+	walSnap := walpb.Snapshot{
+		Index: snapshot.Metadata.Index,
+		Term:  snapshot.Metadata.Term,
+	}
+	return n.wal.SaveSnapshot(walSnap)
+}
+
+// maybeTriggerSnapshot checks whether enough entries have been applied
+// since the last snapshot to justify compacting the raft log. Compaction
+// keeps the in-memory log from growing without bound (the WAL is not
+// trimmed), at the cost of requiring lagging followers to catch up via a
+// full snapshot transfer instead of an incremental log replay.
+func (n *Node) maybeTriggerSnapshot() {
+	if n.appliedIndex-n.snapshotIndex <= n.snapshotCount() {
+		return
+	}
+
+	data, err := n.memoryStore.Save()
+	if err != nil {
+		n.Config.Logger.Errorf("raft: failed to save store for snapshot: %v", err)
+		return
+	}
+
+	snap, err := n.raftStore.CreateSnapshot(n.appliedIndex, &n.confState, data)
+	if err != nil {
+		n.Config.Logger.Errorf("raft: failed to create snapshot: %v", err)
+		return
+	}
+
+	if err := n.saveSnapshot(snap); err != nil {
+		n.Config.Logger.Errorf("raft: failed to persist snapshot: %v", err)
+		return
+	}
+
+	// The last snapshotCount entries before the new snapshot are kept so
+	// that a follower only slightly behind can still catch up from the
+	// log; everything before them is compacted away.
+	compactIndex := uint64(1)
+	if n.appliedIndex > n.snapshotCount() {
+		compactIndex = n.appliedIndex - n.snapshotCount()
+	}
+	if err := n.raftStore.Compact(compactIndex); err != nil && err != raft.ErrCompacted {
+		n.Config.Logger.Errorf("raft: failed to compact log: %v", err)
+		return
+	}
+
+	n.snapshotIndex = n.appliedIndex
+}
+
+func (n *Node) snapshotCount() uint64 {
+	if n.opts.SnapshotCount != 0 {
+		return n.opts.SnapshotCount
+	}
+	return defaultSnapshotCount
+}
+
+// restoreFromSnapshot is invoked when the Ready loop hands us a non-empty
+// snapshot, which happens when this node's log has fallen far enough
+// behind the leader that the entries it needs have already been
+// compacted away. The snapshot holds a full point-in-time copy of the
+// store, serialized the same way maybeTriggerSnapshot produces it.
+func (n *Node) restoreFromSnapshot(snapshot raftpb.Snapshot) error {
+	if err := n.memoryStore.Restore(snapshot.Data); err != nil {
+		return err
+	}
+	n.confState = snapshot.Metadata.ConfState
+	n.appliedIndex = snapshot.Metadata.Index
+	n.snapshotIndex = snapshot.Metadata.Index
+	return nil
+}
+
+// loadAndStart opens the WAL and snapshotter for this node's state
+// directory, loads the most recent snapshot (if any), and replays the
+// WAL entries that follow it into raftStore. This is the restart path:
+// rather than replaying the entire history of the cluster, a node only
+// has to replay the tail of the log after the point the snapshot
+// already covers.
+func (n *Node) loadAndStart() (*wal.WAL, *raftpb.HardState, []raftpb.Entry, error) {
+	n.snapshotter = snap.New(n.snapDir())
+
+	snapshot, err := n.snapshotter.Load()
+	if err != nil && err != snap.ErrNoSnapshot {
+		return nil, nil, nil, err
+	}
+
+	walsnap := walpb.Snapshot{}
+	if snapshot != nil {
+		walsnap.Index = snapshot.Metadata.Index
+		walsnap.Term = snapshot.Metadata.Term
+	}
+
+	w, err := wal.Open(n.walDir(), walsnap)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	_, hs, ents, err := w.ReadAll()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if snapshot != nil {
+		if err := n.raftStore.ApplySnapshot(*snapshot); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := n.memoryStore.Restore(snapshot.Data); err != nil {
+			return nil, nil, nil, err
+		}
+		n.confState = snapshot.Metadata.ConfState
+		n.appliedIndex = snapshot.Metadata.Index
+		n.snapshotIndex = snapshot.Metadata.Index
+	}
+
+	if err := n.raftStore.SetHardState(hs); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := n.raftStore.Append(ents); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return w, &hs, ents, nil
+}
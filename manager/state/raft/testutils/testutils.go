@@ -0,0 +1,296 @@
+// Package testutils provides helpers for standing up and manipulating
+// in-process raft clusters in tests, shared between the raft package's
+// own test suite and any other package that needs to drive a real raft
+// cluster (such as the manager's integration tests).
+package testutils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/swarmkit/api"
+	cautils "github.com/docker/swarmkit/ca/testutils"
+	"github.com/docker/swarmkit/manager/state/raft"
+	"github.com/docker/swarmkit/manager/state/store"
+	"github.com/pivotal-golang/clock/fakeclock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// TestNode wraps a raft.Node together with the grpc plumbing a test needs
+// to tear it down or reconnect to it.
+type TestNode struct {
+	*raft.Node
+	Server   *grpc.Server
+	Listener net.Listener
+}
+
+// NewInitNode creates a new raft node acting as the initial member of a
+// brand new cluster.
+func NewInitNode(t *testing.T, tc *cautils.TestCA, opts *raft.NewNodeOptions) (*TestNode, *fakeclock.FakeClock) {
+	clockSource := fakeclock.NewFakeClock(time.Now())
+	n := NewNode(t, clockSource, tc, withOpts(opts, raft.NewNodeOptions{}))
+	go n.Run(context.Background())
+	return n, clockSource
+}
+
+// NewJoinNode creates a new raft node that joins an existing cluster
+// through joinAddr.
+func NewJoinNode(t *testing.T, clockSource *fakeclock.FakeClock, joinAddr string, tc *cautils.TestCA) *TestNode {
+	return NewJoinNodeWithOpts(t, clockSource, joinAddr, tc, nil)
+}
+
+// NewJoinNodeWithOpts is like NewJoinNode, but lets the caller override
+// NewNodeOptions fields (such as SnapshotCount) other than Addr,
+// ClockSource, StateDir and JoinAddr, which the harness always sets
+// itself.
+func NewJoinNodeWithOpts(t *testing.T, clockSource *fakeclock.FakeClock, joinAddr string, tc *cautils.TestCA, opts *raft.NewNodeOptions) *TestNode {
+	o := withOpts(opts, raft.NewNodeOptions{})
+	o.JoinAddr = joinAddr
+	n := NewNode(t, clockSource, tc, o)
+	go n.Run(context.Background())
+	return n
+}
+
+// NewNode creates and starts the grpc listener for a new raft node, but
+// leaves running the node's main loop to the caller.
+func NewNode(t *testing.T, clockSource *fakeclock.FakeClock, tc *cautils.TestCA, opts raft.NewNodeOptions) *TestNode {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	opts.Addr = l.Addr().String()
+	opts.ClockSource = clockSource
+	opts.StateDir, err = ioutil.TempDir("", "raft-test-")
+	require.NoError(t, err)
+
+	n, err := raft.NewNode(opts)
+	require.NoError(t, err)
+
+	s := grpc.NewServer()
+	raft.Register(s, n)
+
+	tn := &TestNode{Node: n, Server: s, Listener: l}
+	go s.Serve(l)
+
+	return tn
+}
+
+// NewRaftCluster brings up a 3 node cluster, with node 1 as the initial
+// member and nodes 2 and 3 joining it.
+func NewRaftCluster(t *testing.T, tc *cautils.TestCA) (map[uint64]*TestNode, *fakeclock.FakeClock) {
+	return NewRaftClusterWithOpts(t, tc, nil)
+}
+
+// NewRaftClusterWithOpts is like NewRaftCluster, but lets the caller
+// override NewNodeOptions fields (such as SnapshotCount, to exercise
+// compaction without applying thousands of entries) applied to every
+// node in the cluster.
+func NewRaftClusterWithOpts(t *testing.T, tc *cautils.TestCA, opts *raft.NewNodeOptions) (map[uint64]*TestNode, *fakeclock.FakeClock) {
+	nodes := make(map[uint64]*TestNode)
+	var clockSource *fakeclock.FakeClock
+	nodes[1], clockSource = NewInitNode(t, tc, opts)
+	AddRaftNodeWithOpts(t, clockSource, nodes, tc, opts)
+	AddRaftNodeWithOpts(t, clockSource, nodes, tc, opts)
+	WaitForCluster(t, clockSource, nodes)
+	return nodes, clockSource
+}
+
+// AddRaftNode joins a new node to the given cluster as a full voting
+// member, storing it in nodes under the next free index (len(nodes)+1).
+func AddRaftNode(t *testing.T, clockSource *fakeclock.FakeClock, nodes map[uint64]*TestNode, tc *cautils.TestCA) {
+	AddRaftNodeWithOpts(t, clockSource, nodes, tc, nil)
+}
+
+// AddRaftNodeWithOpts is like AddRaftNode, but lets the caller override
+// NewNodeOptions fields for the joining node.
+func AddRaftNodeWithOpts(t *testing.T, clockSource *fakeclock.FakeClock, nodes map[uint64]*TestNode, tc *cautils.TestCA, opts *raft.NewNodeOptions) {
+	n := NewJoinNodeWithOpts(t, clockSource, nodes[1].Address, tc, opts)
+	nodes[uint64(len(nodes)+1)] = n
+	WaitForCluster(t, clockSource, nodes)
+
+	// Join admits the node as a learner; promote it so it counts toward
+	// quorum like the members it joined.
+	require.NoError(t, PollFunc(clockSource, func() error {
+		leader := Leader(nodes)
+		if leader == nil {
+			return fmt.Errorf("no leader elected")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := leader.PromoteMember(ctx, &api.PromoteMemberRequest{RaftID: n.Config.ID})
+		return err
+	}))
+}
+
+// RestartNode starts a fresh node bound to the same state directory and
+// address as node, simulating a process restart that must recover from
+// the WAL/snapshot on disk. It does not stop node itself.
+func RestartNode(t *testing.T, clockSource *fakeclock.FakeClock, node *TestNode, forceNewCluster bool) *TestNode {
+	opts := raft.NewNodeOptions{
+		ID:              fmt.Sprintf("%x", node.Config.ID),
+		Addr:            node.Address,
+		StateDir:        node.StateDir,
+		ClockSource:     clockSource,
+		ForceNewCluster: forceNewCluster,
+	}
+
+	n, err := raft.NewNode(opts)
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", node.Address)
+	require.NoError(t, err)
+
+	s := grpc.NewServer()
+	raft.Register(s, n)
+
+	tn := &TestNode{Node: n, Server: s, Listener: l}
+	go s.Serve(l)
+	go n.Run(context.Background())
+
+	return tn
+}
+
+// TeardownCluster stops every node in the cluster and its grpc server.
+func TeardownCluster(t *testing.T, nodes map[uint64]*TestNode) {
+	for _, n := range nodes {
+		n.Server.Stop()
+		n.Stop()
+	}
+}
+
+// Leader returns the TestNode that the cluster currently agrees is
+// leader.
+func Leader(nodes map[uint64]*TestNode) *TestNode {
+	for _, n := range nodes {
+		if n.IsLeader() {
+			return n
+		}
+	}
+	return nil
+}
+
+// ProposeValue proposes a test api.Node value through the given node,
+// returning the value that was proposed so the caller can assert it was
+// replicated.
+func ProposeValue(t *testing.T, node *TestNode, nodeID ...string) (*api.Node, error) {
+	id := "id1"
+	if len(nodeID) != 0 {
+		id = nodeID[0]
+	}
+
+	n := &api.Node{ID: id}
+	err := node.ProposeValue(context.Background(), []*api.StoreAction{
+		{
+			Action: api.StoreActionKindCreate,
+			Target: &api.StoreAction_Node{Node: n},
+		},
+	}, nil)
+	return n, err
+}
+
+// CheckValue polls the node's store until it contains the given value.
+func CheckValue(t *testing.T, clockSource *fakeclock.FakeClock, node *TestNode, expected *api.Node) {
+	assert.NoError(t, PollFunc(clockSource, func() error {
+		var err error
+		node.MemoryStore().View(func(tx store.ReadTx) {
+			n := store.GetNode(tx, expected.ID)
+			if n == nil {
+				err = fmt.Errorf("node %s not found", expected.ID)
+			}
+		})
+		return err
+	}))
+}
+
+// CheckValuesOnNodes polls every given node's store until every one of
+// the given ids/values is present.
+func CheckValuesOnNodes(t *testing.T, clockSource *fakeclock.FakeClock, nodes map[uint64]*TestNode, ids []string, values []*api.Node) {
+	for _, node := range nodes {
+		for i, id := range ids {
+			CheckValue(t, clockSource, node, values[i])
+			_ = id
+		}
+	}
+}
+
+// CheckNoValue verifies that the node's store has no nodes in it.
+func CheckNoValue(t *testing.T, clockSource *fakeclock.FakeClock, node *TestNode) {
+	node.MemoryStore().View(func(tx store.ReadTx) {
+		nodes, err := store.FindNodes(tx, store.All)
+		assert.NoError(t, err)
+		assert.Empty(t, nodes)
+	})
+}
+
+// WaitForCluster waits for every given node to agree on the same leader
+// and to have settled on the full expected memberlist.
+func WaitForCluster(t *testing.T, clockSource *fakeclock.FakeClock, nodes map[uint64]*TestNode) {
+	assert.NoError(t, PollFunc(clockSource, func() error {
+		var leader uint64
+		for _, n := range nodes {
+			if n.IsLeader() {
+				leader = n.Config.ID
+			}
+		}
+		if leader == 0 {
+			return fmt.Errorf("no leader elected")
+		}
+		for _, n := range nodes {
+			if n.Leader() != leader {
+				return fmt.Errorf("node %x sees leader %x, want %x", n.Config.ID, n.Leader(), leader)
+			}
+			if len(n.GetMemberlist()) != len(nodes) {
+				return fmt.Errorf("node %x has %d members, want %d", n.Config.ID, len(n.GetMemberlist()), len(nodes))
+			}
+		}
+		return nil
+	}))
+}
+
+// WaitForPeerNumber waits until every node in the cluster reports exactly
+// count members.
+func WaitForPeerNumber(t *testing.T, clockSource *fakeclock.FakeClock, nodes map[uint64]*TestNode, count int) {
+	assert.NoError(t, PollFunc(clockSource, func() error {
+		for _, n := range nodes {
+			if len(n.GetMemberlist()) != count {
+				return fmt.Errorf("node %x has %d members, want %d", n.Config.ID, len(n.GetMemberlist()), count)
+			}
+		}
+		return nil
+	}))
+}
+
+// AdvanceTicks advances the fake clock by count raft ticks.
+func AdvanceTicks(clockSource *fakeclock.FakeClock, count int) {
+	for i := 0; i < count; i++ {
+		clockSource.Increment(time.Second)
+	}
+}
+
+// PollFunc repeatedly calls f, advancing the fake clock between
+// attempts, until it returns nil or a timeout elapses.
+func PollFunc(clockSource *fakeclock.FakeClock, f func() error) error {
+	var err error
+	for i := 0; i < 100; i++ {
+		if err = f(); err == nil {
+			return nil
+		}
+		if clockSource != nil {
+			clockSource.Increment(100 * time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
+
+func withOpts(opts *raft.NewNodeOptions, def raft.NewNodeOptions) raft.NewNodeOptions {
+	if opts == nil {
+		return def
+	}
+	return *opts
+}
@@ -0,0 +1,138 @@
+package raft
+
+import (
+	"time"
+
+	"github.com/coreos/etcd/raft/raftpb"
+	"github.com/docker/swarmkit/api"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// snapChunkSize is the maximum number of bytes of snapshot data sent in a
+// single StreamRaftMessage chunk. A MemoryStore snapshot can run into the
+// tens of megabytes, well past the default grpc message size limit, so a
+// raftpb.Message carrying a snapshot is never sent whole: it is split into
+// chunks of this size and reassembled by the receiver before being handed
+// to raft.Node.Step.
+const snapChunkSize = 1024 * 1024 // 1MB
+
+// raftClient wraps the generated Raft service client with the member's
+// connection, so the rest of the package can just call send/sendSnapshot
+// without worrying about the underlying RPC shape.
+type raftClient struct {
+	api.RaftClient
+	Conn *grpc.ClientConn
+}
+
+// Register registers this node's Raft gRPC service on the given server.
+func Register(s *grpc.Server, n *Node) {
+	api.RegisterRaftServer(s, n)
+}
+
+// ConnectToMember opens a grpc connection to another raft member's
+// address.
+func (n *Node) ConnectToMember(addr string, timeout time.Duration) (*raftClient, error) {
+	return ConnectToMember(addr, timeout)
+}
+
+// ConnectToMember opens a grpc connection to another raft member's
+// address.
+func ConnectToMember(addr string, timeout time.Duration) (*raftClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return nil, err
+	}
+
+	return &raftClient{RaftClient: api.NewRaftClient(conn), Conn: conn}, nil
+}
+
+// send forwards a single raft message to this member, taking the chunked
+// streaming path for MsgSnap (whose payload may be arbitrarily large) and
+// the plain unary RPC for everything else.
+func (c *raftClient) send(ctx context.Context, m raftpb.Message) error {
+	if m.Type != raftpb.MsgSnap {
+		_, err := c.ProcessRaftMessage(ctx, &api.ProcessRaftMessageRequest{Message: &m})
+		return err
+	}
+	return c.sendSnapshot(ctx, m)
+}
+
+// sendSnapshot streams a MsgSnap message to the member in fixed-size
+// chunks over StreamRaftMessage, so that a multi-megabyte MemoryStore
+// snapshot never has to fit inside a single grpc message.
+func (c *raftClient) sendSnapshot(ctx context.Context, m raftpb.Message) error {
+	stream, err := c.StreamRaftMessage(ctx)
+	if err != nil {
+		return err
+	}
+
+	data := m.Snapshot.Data
+	header := m
+	header.Snapshot.Data = nil
+
+	for offset := 0; offset <= len(data); offset += snapChunkSize {
+		end := offset + snapChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		chunk := &api.StreamRaftMessageRequest{
+			Message: &header,
+			Data:    data[offset:end],
+			Last:    end == len(data),
+		}
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+	}
+
+	_, err = stream.CloseAndRecv()
+	return err
+}
+
+// ProcessRaftMessage implements the unary half of the Raft gRPC service,
+// used for every message type except MsgSnap.
+func (n *Node) ProcessRaftMessage(ctx context.Context, req *api.ProcessRaftMessageRequest) (*api.ProcessRaftMessageResponse, error) {
+	if err := n.raftNode.Step(ctx, *req.Message); err != nil {
+		return nil, err
+	}
+	return &api.ProcessRaftMessageResponse{}, nil
+}
+
+// StreamRaftMessage implements the streaming half of the Raft gRPC
+// service. It reassembles a chunked MsgSnap sent by sendSnapshot into a
+// single in-memory byte slice before stepping it into the local raft
+// node, so raft itself never has to know the snapshot arrived in pieces.
+func (n *Node) StreamRaftMessage(stream api.Raft_StreamRaftMessageServer) error {
+	var (
+		header *raftpb.Message
+		data   []byte
+	)
+
+	for {
+		chunk, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		if header == nil {
+			header = chunk.Message
+		}
+		data = append(data, chunk.Data...)
+
+		if chunk.Last {
+			break
+		}
+	}
+
+	header.Snapshot.Data = data
+	if err := n.raftNode.Step(stream.Context(), *header); err != nil {
+		return err
+	}
+
+	return stream.SendAndClose(&api.StreamRaftMessageResponse{})
+}
@@ -0,0 +1,50 @@
+package raft_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/docker/swarmkit/api"
+	raftutils "github.com/docker/swarmkit/manager/state/raft/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRaftProposeConcurrent exercises the request-ID based wait registry
+// under load: many goroutines propose values on the leader concurrently,
+// and every one of them must return without error, with its value then
+// replicated to a follower.
+func TestRaftProposeConcurrent(t *testing.T) {
+	t.Parallel()
+
+	nodes, clockSource := raftutils.NewRaftCluster(t, tc)
+	defer raftutils.TeardownCluster(t, nodes)
+
+	const n = 2000
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	values := make(chan *api.Node, n)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value, err := raftutils.ProposeValue(t, nodes[1], "concurrent-"+strconv.Itoa(i))
+			errs <- err
+			values <- value
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	close(values)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	for value := range values {
+		raftutils.CheckValue(t, clockSource, nodes[2], value)
+	}
+}